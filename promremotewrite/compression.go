@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compress encodes data for shardID using the algorithm selected by
+// --compression (or the runtime snappy fallback, see downgradeToSnappy),
+// returning the encoded bytes and the Content-Encoding header value to send
+// alongside them.
+func compress(shardID int, data []byte) (encoded []byte, contentEncoding string) {
+	algo := *compression
+	if atomic.LoadInt32(&downgradedToSnappy) == 1 {
+		algo = "snappy"
+	}
+	switch algo {
+	case "zstd":
+		return zstdPool.encode(shardID, data), "zstd"
+	case "gzip":
+		return gzipEncode(data), "gzip"
+	default:
+		return snappy.Encode(nil, data), "snappy"
+	}
+}
+
+// zstdEncoderPool hands out a *zstd.Encoder per shard ID, reusing it across
+// that shard's sends rather than allocating one per request. Each shard
+// only ever calls encode from its own goroutine, so no locking is needed on
+// the hot path once a lane has been initialized.
+type zstdEncoderPool struct {
+	mu       sync.Mutex
+	encoders []*zstd.Encoder
+}
+
+var zstdPool = &zstdEncoderPool{}
+
+func (p *zstdEncoderPool) encode(shardID int, data []byte) []byte {
+	enc := p.lane(shardID)
+	return enc.EncodeAll(data, nil)
+}
+
+func (p *zstdEncoderPool) lane(shardID int) *zstd.Encoder {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if shardID >= len(p.encoders) {
+		grown := make([]*zstd.Encoder, shardID+1)
+		copy(grown, p.encoders)
+		p.encoders = grown
+	}
+	if p.encoders[shardID] == nil {
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			// Only returns an error for invalid EOptions, of which we pass
+			// none, so this can't happen in practice.
+			panic(fmt.Sprintf("zstd: creating encoder: %v", err))
+		}
+		p.encoders[shardID] = enc
+	}
+	return p.encoders[shardID]
+}
+
+// gzipWriterPool reuses *gzip.Writer instances across sends, as recommended
+// by the compress/gzip docs for high-frequency callers.
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+func gzipEncode(data []byte) []byte {
+	w := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(w)
+
+	var buf bytes.Buffer
+	w.Reset(&buf)
+	// Writes to a bytes.Buffer never fail.
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
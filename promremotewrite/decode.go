@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// multiCloser closes, in order, every closer it was built with, so an
+// input reader chained on top of an *os.File (gzip.Reader -> file,
+// zstd.Decoder -> file) releases both layers. It returns the first error
+// encountered, if any.
+type multiCloser struct {
+	io.Reader
+	closers []func() error
+}
+
+func (m *multiCloser) Close() error {
+	var firstErr error
+	for _, c := range m.closers {
+		if err := c(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// gzipMagic and zstdMagic are the leading bytes of a gzip or zstd stream,
+// used to detect compressed input that doesn't carry a recognized suffix.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// openInputReader opens fname and, if it's gzip or zstd compressed (by
+// ".gz"/".zst" suffix or magic bytes), wraps it in the matching
+// decompressor so callers always see the raw JSON stream.
+func openInputReader(fname string) (io.ReadCloser, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case strings.HasSuffix(fname, ".gz") || hasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("opening gzip input %s: %w", fname, err)
+		}
+		return &multiCloser{Reader: gr, closers: []func() error{gr.Close, f.Close}}, nil
+	case strings.HasSuffix(fname, ".zst") || hasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("opening zstd input %s: %w", fname, err)
+		}
+		return &multiCloser{Reader: zr, closers: []func() error{func() error { zr.Close(); return nil }, f.Close}}, nil
+	default:
+		return &multiCloser{Reader: br, closers: []func() error{f.Close}}, nil
+	}
+}
+
+func hasPrefix(b, prefix []byte) bool {
+	return len(b) >= len(prefix) && string(b[:len(prefix)]) == string(prefix)
+}
+
+// decodeSampleStreams streams a top-level JSON array of InputSeries objects
+// from r, invoking fn once per decoded element. Unlike
+// ioutil.ReadFile+json.Unmarshal, this never holds more than one element
+// (plus whatever fn itself buffers) in memory, so files far larger than
+// available RAM can be processed.
+func decodeSampleStreams(r io.Reader, fn func(*InputSeries) error) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("reading opening token: %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected input to be a top-level JSON array, got %v", tok)
+	}
+	for dec.More() {
+		var s InputSeries
+		if err := dec.Decode(&s); err != nil {
+			return fmt.Errorf("decoding series: %w", err)
+		}
+		if err := fn(&s); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("reading closing token: %w", err)
+	}
+	return nil
+}
+
+// approxStreamSize estimates the in-memory footprint of a decoded
+// InputSeries. It doesn't need to be exact, only roughly proportional to
+// actual memory use, since it's only used to decide when a batch has grown
+// large enough to flush under --max_memory.
+func approxStreamSize(s *InputSeries) int64 {
+	size := int64(64)
+	for k, v := range s.Metric {
+		size += int64(len(k) + len(v) + 16)
+	}
+	size += int64(len(s.Values)) * 32
+	size += int64(len(s.Histograms)) * 128
+	size += int64(len(s.Exemplars)) * 64
+	return size
+}
+
+// processInputFile streams fname (transparently decompressing gzip/zstd
+// input) one SampleStream at a time, accumulating them into batches of at
+// most --max_memory estimated bytes before handing each batch to
+// generateWriteRequests, so --max_memory bounds peak memory independent of
+// how large the input file is.
+func processInputFile(fname string, wal *WAL, tenants *tenantMap) error {
+	r, err := openInputReader(fname)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var batch []*InputSeries
+	var batchBytes int64
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := generateWriteRequests(batch, wal, tenants); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		batchBytes = 0
+		return nil
+	}
+
+	err = decodeSampleStreams(r, func(s *InputSeries) error {
+		batch = append(batch, s)
+		batchBytes += approxStreamSize(s)
+		if batchBytes >= *maxMemory {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
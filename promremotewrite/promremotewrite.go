@@ -8,7 +8,6 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -16,30 +15,73 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 	"golang.org/x/net/context/ctxhttp"
 )
 
 var (
-	writeURL     = flag.String("url", "", "URL for remote write endpoint")
-	writeTimeout = flag.Duration("write_timeout", 5*time.Minute, "write timeout")
-	batchSize    = flag.Uint("batch_size", 100000, "number of samples per request")
-	requestSpan  = flag.Duration("request_span", time.Minute, "maximum duration that one request can span in terms of samples it contains")
-	concurrency  = flag.Uint("concurrency", 1, "number of influxdb writers")
-	headersStr   = flag.String("headers", "", "additional HTTP headers. must be pairs seperated by \",\", the pairs are split by \":\", for example \"X-Scope-OrgID:1234,X-Org-Id:1234\"")
-	headers      = make(map[string]string)
+	writeURL        = flag.String("url", "", "URL for remote write endpoint")
+	writeTimeout    = flag.Duration("write_timeout", 5*time.Minute, "write timeout")
+	batchSize       = flag.Uint("batch_size", 100000, "number of samples per request")
+	requestSpan     = flag.Duration("request_span", time.Minute, "maximum duration that one request can span in terms of samples it contains")
+	concurrency     = flag.Uint("concurrency", 1, "initial number of send shards; the shard pool grows and shrinks from here as backlog builds or drains")
+	maxShards       = flag.Uint("max_shards", 16, "maximum number of send shards the reshard controller may grow the pool to")
+	reshardInterval = flag.Duration("reshard_interval", 10*time.Second, "how often the moving-average in-rate/out-rate ratio is recomputed to grow or shrink the shard pool")
+	maxBatchAge     = flag.Duration("max_batch_age", 5*time.Second, "maximum time a shard holds a partial batch before flushing it, even if batch_size hasn't been reached")
+	walDir          = flag.String("wal_dir", "", "directory for the durable send queue's write-ahead log; if set, an interrupted run can be resumed by pointing a new run at the same directory. defaults to a temporary directory that is not resumable")
+	protocol        = flag.String("protocol", "prw1", "remote write protocol to speak: \"prw1\" for the classic prompb.WriteRequest, or \"prw2\" for Remote Write 2.0 (io.prometheus.write.v2.Request) with per-request symbol table encoding")
+	compression     = flag.String("compression", "snappy", "compression to use for the request body: \"snappy\" (default, classic), \"zstd\", or \"gzip\"")
+	tenantLabel     = flag.String("tenant_label", "", "if set, the label whose value routes each series to a separate tenant destination, inspired by cortex-tenant")
+	tenantHeader    = flag.String("tenant_header", "X-Scope-OrgID", "HTTP header used to identify the tenant to the remote write endpoint")
+	tenantMapPath   = flag.String("tenant_map", "", "optional YAML file rewriting --tenant_label values to tenant IDs, with a default bucket and a drop list")
+	maxMemory       = flag.Int64("max_memory", 256<<20, "approximate number of bytes of decoded series to buffer before flushing them to the send queue; bounds peak memory independent of input file size, at the cost of aligning request_span windows per flushed batch rather than across the whole file")
+	headersStr      = flag.String("headers", "", "additional HTTP headers. must be pairs seperated by \",\", the pairs are split by \":\", for example \"X-Scope-OrgID:1234,X-Org-Id:1234\"")
+	headers         = make(map[string]string)
+
+	// downgradedToV1 latches to true the first time a prw2 request is
+	// rejected with 415 Unsupported Media Type, so the remainder of the
+	// run falls back to prw1 instead of failing every batch against a
+	// receiver that doesn't speak Remote Write 2.0.
+	downgradedToV1 int32
+
+	// downgradedToSnappy latches to true the first time a non-snappy
+	// request is rejected with 415, so the remainder of the run falls
+	// back to the compression every remote write receiver is expected to
+	// support.
+	downgradedToSnappy int32
+
+	// histogramDropWarned latches to true the first time a batch with
+	// native histograms is sent over prw1, which has no room for them in
+	// this tool's vendored prompb, so the warning isn't repeated once per
+	// batch for the rest of the run.
+	histogramDropWarned int32
+
+	// exemplarDropWarned latches to true the first time a batch with
+	// exemplars is sent over prw1, which (like native histograms) prw1
+	// has no room for, so the warning isn't repeated once per batch for
+	// the rest of the run.
+	exemplarDropWarned int32
 )
 
-// converts a slice of SampleStream messages into remote write requests and sends them into the channel.
-func generateWriteRequests(streams []*model.SampleStream, requests chan<- *prompb.WriteRequest) {
+// generateWriteRequests splits a slice of InputSeries into per-window
+// TimeSeries (plus whatever histograms and exemplars fall in that window)
+// and durably appends each one to the WAL tagged with its destination
+// tenant, where it will be picked up by that tenant's queue manager for
+// delivery. If --tenant_label is set, the tenant for each stream is
+// resolved (and the label stripped from the outgoing series) before any
+// batching happens; streams resolving to the tenant map's drop list are
+// skipped entirely.
+func generateWriteRequests(streams []*InputSeries, wal *WAL, tenants *tenantMap) error {
 	lowestTimestamp := int64(math.MaxInt64)
 	highestTimestamp := int64(math.MinInt64)
 	for _, s := range streams {
@@ -52,24 +94,41 @@ func generateWriteRequests(streams []*model.SampleStream, requests chan<- *promp
 				highestTimestamp = timestamp
 			}
 		}
+		for _, h := range s.Histograms {
+			if h.Timestamp < lowestTimestamp {
+				lowestTimestamp = h.Timestamp
+			}
+			if h.Timestamp > highestTimestamp {
+				highestTimestamp = h.Timestamp
+			}
+		}
+		for _, e := range s.Exemplars {
+			if e.Timestamp < lowestTimestamp {
+				lowestTimestamp = e.Timestamp
+			}
+			if e.Timestamp > highestTimestamp {
+				highestTimestamp = e.Timestamp
+			}
+		}
 	}
 
 	log.Printf("Lowest timestamp: %v", time.UnixMilli(lowestTimestamp))
 	log.Printf("Highest timestamp: %v", time.UnixMilli(highestTimestamp))
 
+	metrics, tenantOf := routeByTenant(streams, tenants)
+
 	// Align the start time to the nearest multiple of requestSpan
 	alignedStart := (lowestTimestamp / requestSpan.Milliseconds()) * requestSpan.Milliseconds()
 
 	for timeStart := alignedStart; timeStart <= highestTimestamp; timeStart += requestSpan.Milliseconds() {
 		timeEnd := timeStart + requestSpan.Milliseconds()
 
-		spanReq := &prompb.WriteRequest{
-			Timeseries: make([]*prompb.TimeSeries, 0),
-		}
-
 		totalSamples := uint(0)
 		spanSamples := uint(0)
-		for _, s := range streams {
+		for i, s := range streams {
+			if metrics[i] == nil {
+				continue // dropped by the tenant map
+			}
 			samples := make([]*prompb.Sample, 0)
 			for _, v := range s.Values {
 				ts := int64(v.Timestamp)
@@ -84,35 +143,93 @@ func generateWriteRequests(streams []*model.SampleStream, requests chan<- *promp
 				}
 			}
 
-			if len(samples) > 0 {
+			var histograms []inputHistogram
+			for _, h := range s.Histograms {
+				if h.Timestamp >= timeStart && h.Timestamp < timeEnd {
+					histograms = append(histograms, h)
+				}
+			}
+			var exemplars []inputExemplar
+			for _, e := range s.Exemplars {
+				if e.Timestamp >= timeStart && e.Timestamp < timeEnd {
+					exemplars = append(exemplars, e)
+				}
+			}
+
+			if len(samples) > 0 || len(histograms) > 0 || len(exemplars) > 0 {
 				labelStr := ""
-				for _, l := range metricToLabelProtos(s.Metric) {
+				for _, l := range metricToLabelProtos(metrics[i]) {
 					labelStr += fmt.Sprintf("%s=%s, ", l.Name, l.Value)
 				}
 				// Trim trailing comma and space
 				labelStr = strings.TrimSuffix(labelStr, ", ")
 
-				log.Printf("Time series {%s} has %d samples in time range [%v, %v]",
+				log.Printf("Time series {%s} (tenant %q) has %d samples, %d histograms, and %d exemplars in time range [%v, %v]",
 					labelStr,
+					tenantOf[i],
 					len(samples),
-					time.UnixMilli(samples[0].Timestamp),
-					time.UnixMilli(samples[len(samples)-1].Timestamp))
-				ts := prompb.TimeSeries{
-					Labels:  metricToLabelProtos(s.Metric),
+					len(histograms),
+					len(exemplars),
+					time.UnixMilli(timeStart),
+					time.UnixMilli(timeEnd))
+				ts := &prompb.TimeSeries{
+					Labels:  metricToLabelProtos(metrics[i]),
 					Samples: samples,
 				}
-				spanReq.Timeseries = append(spanReq.Timeseries, &ts)
+				data, err := proto.Marshal(ts)
+				if err != nil {
+					return fmt.Errorf("marshaling series for WAL: %w", err)
+				}
+				record, err := encodeWALRecord(tenantOf[i], data, histograms, exemplars)
+				if err != nil {
+					return fmt.Errorf("encoding WAL record: %w", err)
+				}
+				if _, err := wal.Append(record); err != nil {
+					return fmt.Errorf("appending series to WAL: %w", err)
+				}
 			}
 		}
 
 		if spanSamples > 0 {
-			log.Printf("Sending batch of %d samples for time window [%v, %v]",
+			log.Printf("Appended %d samples for time window [%v, %v] to the send queue",
 				spanSamples,
 				time.UnixMilli(timeStart),
 				time.UnixMilli(timeEnd))
-			requests <- spanReq
 		}
 	}
+	return nil
+}
+
+// routeByTenant resolves the destination tenant for each stream and
+// returns, in parallel with streams, the metric to actually send (with the
+// tenant label stripped, or nil if the stream should be dropped) and the
+// resolved tenant ID.
+func routeByTenant(streams []*InputSeries, tenants *tenantMap) ([]model.Metric, []string) {
+	metrics := make([]model.Metric, len(streams))
+	tenantOf := make([]string, len(streams))
+
+	for i, s := range streams {
+		if *tenantLabel == "" {
+			metrics[i] = s.Metric
+			continue
+		}
+		raw := string(s.Metric[model.LabelName(*tenantLabel)])
+		tenant, drop := tenants.resolve(raw)
+		if drop {
+			log.Printf("dropping series with %s=%q per tenant map", *tenantLabel, raw)
+			continue
+		}
+		stripped := make(model.Metric, len(s.Metric))
+		for k, v := range s.Metric {
+			if k == model.LabelName(*tenantLabel) {
+				continue
+			}
+			stripped[k] = v
+		}
+		metrics[i] = stripped
+		tenantOf[i] = tenant
+	}
+	return metrics, tenantOf
 }
 
 // metricToLabelProtos builds a []*prompb.Label from a model.Metric
@@ -132,27 +249,68 @@ func metricToLabelProtos(metric model.Metric) []*prompb.Label {
 	return labels
 }
 
-// write sends a WriteRequest to a remote write endpoint using an http client.
+// write marshals batch using the configured wire protocol and compression,
+// and sends it to the remote write endpoint on behalf of tenant (empty if
+// tenant routing is disabled). A non-2xx response is returned as an
+// *httpError so callers can tell a transient failure (5xx, 429) from a
+// permanent one (other 4xx). A 415 latches the narrowest available
+// downgrade (compression first, then protocol) and retries, so a receiver
+// that only speaks a subset of what we're sending doesn't fail the rest of
+// the run.
 // Copy/pasted from prometheus/storage/remote/client.go.
-func write(client *http.Client, req *prompb.WriteRequest) error {
-	data, err := proto.Marshal(req)
+func write(client *http.Client, shardID int, batch []*seriesRecord, tenant string) error {
+	usePrw2 := *protocol == "prw2" && atomic.LoadInt32(&downgradedToV1) == 0
+
+	var data []byte
+	var err error
+	if usePrw2 {
+		data = buildWriteRequestV2(batch)
+	} else {
+		tsBatch := make([]*prompb.TimeSeries, len(batch))
+		hasHistograms := false
+		hasExemplars := false
+		for i, rec := range batch {
+			tsBatch[i] = rec.ts
+			if len(rec.histograms) > 0 {
+				hasHistograms = true
+			}
+			if len(rec.exemplars) > 0 {
+				hasExemplars = true
+			}
+		}
+		if hasHistograms && atomic.CompareAndSwapInt32(&histogramDropWarned, 0, 1) {
+			log.Printf("remote write protocol prw1 has no room for native histograms in this tool's vendored prompb; dropping them for the rest of the run (use --protocol=prw2 to send them)")
+		}
+		if hasExemplars && atomic.CompareAndSwapInt32(&exemplarDropWarned, 0, 1) {
+			log.Printf("remote write protocol prw1 has no room for exemplars in this tool's vendored prompb; dropping them for the rest of the run (use --protocol=prw2 to send them)")
+		}
+		data, err = proto.Marshal(&prompb.WriteRequest{Timeseries: tsBatch})
+	}
 	if err != nil {
 		return err
 	}
 
-	compressed := snappy.Encode(nil, data)
+	compressed, contentEncoding := compress(shardID, data)
 	httpReq, err := http.NewRequest("POST", *writeURL, bytes.NewReader(compressed))
 	if err != nil {
 		// Errors from NewRequest are from unparseable URLs, so are not
 		// recoverable.
 		return err
 	}
-	httpReq.Header.Add("Content-Encoding", "snappy")
-	httpReq.Header.Set("Content-Type", "application/x-protobuf")
-	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	httpReq.Header.Add("Content-Encoding", contentEncoding)
+	if usePrw2 {
+		httpReq.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+		httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "2.0.0")
+	} else {
+		httpReq.Header.Set("Content-Type", "application/x-protobuf")
+		httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	}
 	for k, v := range headers {
 		httpReq.Header.Set(k, v)
 	}
+	if tenant != "" {
+		httpReq.Header.Set(*tenantHeader, tenant)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), *writeTimeout)
 	defer cancel()
@@ -169,12 +327,24 @@ func write(client *http.Client, req *prompb.WriteRequest) error {
 		if scanner.Scan() {
 			line = scanner.Text()
 		}
-		err = fmt.Errorf("server returned HTTP status %s: %s", httpResp.Status, line)
-	}
-	if httpResp.StatusCode/100 == 5 {
-		return err
+		if httpResp.StatusCode == http.StatusUnsupportedMediaType {
+			if contentEncoding != "snappy" && atomic.LoadInt32(&downgradedToSnappy) == 0 {
+				log.Printf("remote write endpoint returned 415 for %s compression, falling back to snappy for the rest of the run", contentEncoding)
+				atomic.StoreInt32(&downgradedToSnappy, 1)
+				return write(client, shardID, batch, tenant)
+			}
+			if usePrw2 {
+				log.Printf("remote write endpoint returned 415 for prw2, falling back to prw1 for the rest of the run")
+				atomic.StoreInt32(&downgradedToV1, 1)
+				return write(client, shardID, batch, tenant)
+			}
+		}
+		return &httpError{
+			statusCode: httpResp.StatusCode,
+			err:        fmt.Errorf("server returned HTTP status %s: %s", httpResp.Status, line),
+		}
 	}
-	return err
+	return nil
 }
 
 func main() {
@@ -198,37 +368,143 @@ func main() {
 		}
 	}
 
-	// Buffer 20 requests in RAM to allow the next json file to be read while
-	// we still send requests for the previous one.
-	requests := make(chan *prompb.WriteRequest, 20)
-	var wg sync.WaitGroup
-	for i := uint(0); i < *concurrency; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			c := &http.Client{}
-			for r := range requests {
-				if err := write(c, r); err != nil {
-					log.Fatal(err)
-				}
-			}
-		}()
+	dir := *walDir
+	if dir == "" {
+		var err error
+		dir, err = ioutil.TempDir("", "promremotewrite-wal-")
+		if err != nil {
+			log.Fatalf("creating temporary WAL dir: %v", err)
+		}
+		log.Printf("--wal_dir not set, using temporary (non-resumable) WAL dir %s", dir)
 	}
 
-	for _, fname := range flag.Args() {
-		log.Printf("Processing file %s", fname)
-		contents, err := ioutil.ReadFile(fname)
+	cp := newCheckpoint(dir)
+	startOffset, err := cp.Load()
+	if err != nil {
+		log.Fatalf("loading checkpoint: %v", err)
+	}
+	if startOffset > 0 {
+		log.Printf("resuming from checkpoint at WAL offset %d", startOffset)
+	}
+
+	wal, err := OpenWAL(dir)
+	if err != nil {
+		log.Fatalf("opening WAL: %v", err)
+	}
+
+	reader, err := NewWALReader(wal.Path(), startOffset)
+	if err != nil {
+		log.Fatalf("opening WAL reader: %v", err)
+	}
+
+	var tenants *tenantMap
+	if *tenantMapPath != "" {
+		tenants, err = loadTenantMap(*tenantMapPath)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("loading tenant map: %v", err)
 		}
+	}
 
-		var values []*model.SampleStream
-		err = json.Unmarshal(contents, &values)
+	client := &http.Client{}
+	tracker := newOffsetTracker()
+
+	// qmsMu guards qms, the set of per-tenant queue managers. It's created
+	// lazily as the dispatcher encounters each tenant for the first time,
+	// so a run with tenant routing disabled (tenant always "") ends up
+	// with exactly one manager, same as before tenant routing existed.
+	var qmsMu sync.Mutex
+	qms := make(map[string]*QueueManager)
+	queueManagerFor := func(tenant string) *QueueManager {
+		qmsMu.Lock()
+		defer qmsMu.Unlock()
+		qm, ok := qms[tenant]
+		if !ok {
+			qm = NewQueueManager(client, tracker, tenant, int(*concurrency), int(*maxShards), *reshardInterval, *maxBatchAge)
+			qms[tenant] = qm
+		}
+		return qm
+	}
+
+	dispatchDone := make(chan struct{})
+	go func() {
+		defer close(dispatchDone)
+		for {
+			payload, offset, err := reader.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				log.Fatalf("reading WAL: %v", err)
+			}
+			tenant, seriesData, histograms, exemplars, err := decodeWALRecord(payload)
+			if err != nil {
+				log.Fatalf("decoding WAL record: %v", err)
+			}
+			var ts prompb.TimeSeries
+			if err := proto.Unmarshal(seriesData, &ts); err != nil {
+				log.Fatalf("decoding WAL record: %v", err)
+			}
+			tracker.Add(offset)
+			rec := &seriesRecord{ts: &ts, histograms: histograms, exemplars: exemplars}
+			queueManagerFor(tenant).Enqueue(rec, offset)
+		}
+	}()
+
+	checkpointDone := make(chan struct{})
+	go func() {
+		defer close(checkpointDone)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := cp.Save(tracker.Committed()); err != nil {
+				log.Printf("saving checkpoint: %v", err)
+			}
+		}
+	}()
+
+	ingested := newIngestLog(dir)
+	alreadyIngested, err := ingested.Load()
+	if err != nil {
+		log.Fatalf("loading ingestion log: %v", err)
+	}
+
+	for _, fname := range flag.Args() {
+		abs, err := filepath.Abs(fname)
 		if err != nil {
+			log.Fatalf("resolving path to %s: %v", fname, err)
+		}
+		if alreadyIngested[abs] {
+			log.Printf("skipping %s: already durably queued to this WAL dir by a previous run", fname)
+			continue
+		}
+		log.Printf("Processing file %s", fname)
+		if err := processInputFile(fname, wal, tenants); err != nil {
 			log.Fatal(err)
 		}
-		generateWriteRequests(values, requests)
+		if err := ingested.MarkDone(abs); err != nil {
+			log.Fatalf("recording %s as ingested: %v", fname, err)
+		}
+	}
+
+	// All input has been durably queued. Wait for the reader to drain the
+	// WAL up to what we just wrote, then shut everything down in order.
+	for reader.Offset() < wal.Offset() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	reader.Stop()
+	<-dispatchDone
+	qmsMu.Lock()
+	for _, qm := range qms {
+		qm.Close()
+	}
+	qmsMu.Unlock()
+
+	if err := cp.Save(tracker.Committed()); err != nil {
+		log.Printf("saving final checkpoint: %v", err)
+	}
+	reader.Close()
+	wal.Close()
+	if *walDir == "" {
+		os.RemoveAll(dir)
 	}
-	close(requests)
-	wg.Wait()
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// offsetTracker records which WAL offsets have been durably delivered (or
+// permanently dropped) so the checkpoint can only ever advance over a
+// contiguous run of acknowledged records, even though shards finish
+// processing items out of order.
+type offsetTracker struct {
+	mu        sync.Mutex
+	pending   []int64
+	done      map[int64]bool
+	committed int64
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{done: make(map[int64]bool)}
+}
+
+// Add registers offset as dispatched but not yet acknowledged. Offsets must
+// be added in increasing order, which holds because a single dispatcher
+// goroutine reads the WAL sequentially.
+func (t *offsetTracker) Add(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, offset)
+}
+
+// Ack marks offset as delivered (sent successfully or permanently dropped)
+// and advances the committed watermark over any now-contiguous prefix.
+func (t *offsetTracker) Ack(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[offset] = true
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		delete(t.done, t.pending[0])
+		t.committed = t.pending[0]
+		t.pending = t.pending[1:]
+	}
+}
+
+// Committed returns the highest offset below which every record has been
+// acknowledged.
+func (t *offsetTracker) Committed() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.committed
+}
+
+// queueItem is a single series read off the WAL, on its way to a shard for
+// batching and delivery.
+type queueItem struct {
+	rec    *seriesRecord
+	offset int64
+}
+
+// ewma is a simple exponentially weighted moving average used to smooth the
+// in/out rates that drive resharding decisions.
+type ewma struct {
+	alpha float64
+	value float64
+	init  bool
+}
+
+func (e *ewma) update(sample float64) {
+	if !e.init {
+		e.value = sample
+		e.init = true
+		return
+	}
+	e.value = e.alpha*sample + (1-e.alpha)*e.value
+}
+
+// QueueManager owns a pool of shards that pull series off a shared channel
+// fed by the WAL tail, batches them per-shard, and delivers them to the
+// remote write endpoint with retry/backoff. It periodically resizes the
+// shard pool based on the moving average ratio of arrival rate to send
+// rate, analogous to Prometheus' remote_write queue_manager.
+type QueueManager struct {
+	client  *http.Client
+	tracker *offsetTracker
+	tenant  string // destination tenant ID, or "" if tenant routing is disabled
+
+	sampleCh chan queueItem
+
+	minShards, maxShards int
+	reshardInterval      time.Duration
+	maxBatchAge          time.Duration
+
+	shardsMu sync.Mutex
+	stopCs   []chan struct{}
+	wg       sync.WaitGroup
+
+	dispatched int64 // atomic: items handed to sampleCh since last reshard tick
+	processed  int64 // atomic: items sent or dropped since last reshard tick
+
+	inRate, outRate ewma
+
+	done    chan struct{}
+	stopped chan struct{} // closed once reshardLoop has returned
+}
+
+// NewQueueManager builds a QueueManager with an initial shard count of
+// initShards, growing to at most maxShards as backlog builds. Every batch
+// it sends is attributed to tenant (empty if tenant routing is disabled).
+func NewQueueManager(client *http.Client, tracker *offsetTracker, tenant string, initShards, maxShards int, reshardInterval, maxBatchAge time.Duration) *QueueManager {
+	if initShards < 1 {
+		initShards = 1
+	}
+	if maxShards < initShards {
+		maxShards = initShards
+	}
+	qm := &QueueManager{
+		client:          client,
+		tracker:         tracker,
+		tenant:          tenant,
+		sampleCh:        make(chan queueItem, int(*batchSize)),
+		minShards:       1,
+		maxShards:       maxShards,
+		reshardInterval: reshardInterval,
+		maxBatchAge:     maxBatchAge,
+		inRate:          ewma{alpha: 0.3},
+		outRate:         ewma{alpha: 0.3},
+		done:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+	qm.setShards(initShards)
+	go qm.reshardLoop()
+	return qm
+}
+
+// Enqueue hands a series read from the WAL to the shard pool, blocking if
+// every shard is saturated.
+func (qm *QueueManager) Enqueue(rec *seriesRecord, offset int64) {
+	atomic.AddInt64(&qm.dispatched, 1)
+	qm.sampleCh <- queueItem{rec: rec, offset: offset}
+}
+
+// Shards reports the current shard count.
+func (qm *QueueManager) Shards() int {
+	qm.shardsMu.Lock()
+	defer qm.shardsMu.Unlock()
+	return len(qm.stopCs)
+}
+
+// setShards grows or shrinks the shard pool to n goroutines. Growing starts
+// new shard workers consuming from the shared sampleCh; shrinking signals
+// the most recently started shards to flush and exit.
+func (qm *QueueManager) setShards(n int) {
+	qm.shardsMu.Lock()
+	defer qm.shardsMu.Unlock()
+
+	current := len(qm.stopCs)
+	switch {
+	case n > current:
+		for i := current; i < n; i++ {
+			stop := make(chan struct{})
+			qm.stopCs = append(qm.stopCs, stop)
+			qm.wg.Add(1)
+			go qm.runShard(i, stop)
+		}
+	case n < current:
+		for i := current - 1; i >= n; i-- {
+			close(qm.stopCs[i])
+		}
+		qm.stopCs = qm.stopCs[:n]
+	}
+}
+
+// runShard is the per-shard worker loop: it owns its own in-flight batch
+// and retry state, accumulating series off the shared channel until
+// batchSize or maxBatchAge is reached, then sending with backoff.
+func (qm *QueueManager) runShard(id int, stop chan struct{}) {
+	defer qm.wg.Done()
+
+	var batch []*seriesRecord
+	var offsets []int64
+	timer := time.NewTimer(qm.maxBatchAge)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		qm.sendWithRetry(id, batch)
+		for _, off := range offsets {
+			qm.tracker.Ack(off)
+		}
+		atomic.AddInt64(&qm.processed, int64(len(batch)))
+		batch = nil
+		offsets = nil
+	}
+
+	for {
+		select {
+		case <-stop:
+			flush()
+			return
+		case item, ok := <-qm.sampleCh:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, item.rec)
+			offsets = append(offsets, item.offset)
+			if uint(len(batch)) >= *batchSize {
+				flush()
+				timer.Reset(qm.maxBatchAge)
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(qm.maxBatchAge)
+		}
+	}
+}
+
+// sendWithRetry marshals batch into a WriteRequest and sends it, retrying
+// with exponential backoff on 5xx and 429 responses and dropping the batch
+// on any other 4xx (it will never succeed on retry).
+func (qm *QueueManager) sendWithRetry(shardID int, batch []*seriesRecord) {
+	backoff := time.Second
+	const maxBackoff = 2 * time.Minute
+	for {
+		err := write(qm.client, shardID, batch, qm.tenant)
+		if err == nil {
+			return
+		}
+		var herr *httpError
+		if !asHTTPError(err, &herr) {
+			log.Printf("shard %d: non-retriable error sending batch of %d series, dropping: %v", shardID, len(batch), err)
+			return
+		}
+		if herr.statusCode == http.StatusTooManyRequests || herr.statusCode/100 == 5 {
+			log.Printf("shard %d: retriable error (status %d), backing off %v: %v", shardID, herr.statusCode, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		log.Printf("shard %d: non-retriable status %d, dropping batch of %d series: %v", shardID, herr.statusCode, len(batch), err)
+		return
+	}
+}
+
+// reshardLoop recomputes the desired shard count every reshardInterval
+// based on the moving-average ratio of arrival rate (dispatched) to drain
+// rate (processed): a growing backlog grows the pool, an idle queue shrinks
+// it back down.
+func (qm *QueueManager) reshardLoop() {
+	ticker := time.NewTicker(qm.reshardInterval)
+	defer ticker.Stop()
+	defer close(qm.stopped)
+
+	for {
+		select {
+		case <-qm.done:
+			return
+		case <-ticker.C:
+			dispatched := atomic.SwapInt64(&qm.dispatched, 0)
+			processed := atomic.SwapInt64(&qm.processed, 0)
+			seconds := qm.reshardInterval.Seconds()
+			qm.inRate.update(float64(dispatched) / seconds)
+			qm.outRate.update(float64(processed) / seconds)
+
+			current := qm.Shards()
+			desired := desiredShards(current, qm.inRate.value, qm.outRate.value, len(qm.sampleCh) == 0, qm.minShards, qm.maxShards)
+			if desired != current {
+				log.Printf("resharding from %d to %d shards (in-rate %.1f/s, out-rate %.1f/s)", current, desired, qm.inRate.value, qm.outRate.value)
+				qm.setShards(desired)
+			}
+		}
+	}
+}
+
+// desiredShards computes the target shard count from the current count and
+// the smoothed in/out rates: a backlog growing faster than it drains (or
+// any arrivals at all with nothing draining) grows the pool proportionally
+// to the in/out ratio, and a fully idle queue (empty channel, no arrivals)
+// collapses straight back to minShards rather than decaying gradually. The
+// result is always clamped to [minShards, maxShards].
+func desiredShards(current int, inRate, outRate float64, queueEmpty bool, minShards, maxShards int) int {
+	desired := current
+	if outRate > 0 {
+		desired = int(math.Ceil(float64(current) * (inRate + 1) / (outRate + 1)))
+	} else if inRate > 0 {
+		desired = current + 1
+	}
+	if queueEmpty && inRate == 0 {
+		desired = minShards
+	}
+	if desired > maxShards {
+		desired = maxShards
+	}
+	if desired < minShards {
+		desired = minShards
+	}
+	return desired
+}
+
+// Close stops accepting new work, drains every shard's in-flight batch, and
+// waits for all shards to exit. It waits for reshardLoop to actually return
+// before closing sampleCh/waiting on wg, so a tick already in flight can't
+// race setShards' wg.Add against this Wait.
+func (qm *QueueManager) Close() {
+	close(qm.done)
+	<-qm.stopped
+	close(qm.sampleCh)
+	qm.wg.Wait()
+}
+
+// httpError carries the HTTP status code of a failed remote write so the
+// shard retry loop can distinguish retriable (5xx, 429) from permanent
+// (other 4xx) failures.
+type httpError struct {
+	statusCode int
+	err        error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+// asHTTPError reports whether err is an *httpError, writing it to *target
+// if so.
+func asHTTPError(err error, target **httpError) bool {
+	herr, ok := err.(*httpError)
+	if ok {
+		*target = herr
+	}
+	return ok
+}
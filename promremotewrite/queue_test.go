@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestEWMAUpdate(t *testing.T) {
+	e := ewma{alpha: 0.5}
+
+	// The first sample seeds the average exactly, rather than blending
+	// against the zero value.
+	e.update(10)
+	if e.value != 10 {
+		t.Fatalf("value after seed = %v, want 10", e.value)
+	}
+
+	e.update(20)
+	want := 0.5*20 + 0.5*10
+	if e.value != want {
+		t.Fatalf("value after second update = %v, want %v", e.value, want)
+	}
+}
+
+func TestDesiredShards(t *testing.T) {
+	cases := []struct {
+		name                 string
+		current              int
+		inRate, outRate      float64
+		queueEmpty           bool
+		minShards, maxShards int
+		want                 int
+	}{
+		{
+			name:    "balanced rates keep shard count steady",
+			current: 4, inRate: 10, outRate: 10,
+			minShards: 1, maxShards: 8,
+			want: 4,
+		},
+		{
+			name:    "backlog growing faster than drain grows the pool",
+			current: 2, inRate: 20, outRate: 5,
+			minShards: 1, maxShards: 8,
+			want: 7, // ceil(2 * 21/6)
+		},
+		{
+			name:    "arrivals with no drain yet grows by one",
+			current: 2, inRate: 5, outRate: 0,
+			minShards: 1, maxShards: 8,
+			want: 3,
+		},
+		{
+			name:    "idle queue collapses to minShards",
+			current: 6, inRate: 0, outRate: 0, queueEmpty: true,
+			minShards: 1, maxShards: 8,
+			want: 1,
+		},
+		{
+			name:    "result is clamped to maxShards",
+			current: 4, inRate: 1000, outRate: 1,
+			minShards: 1, maxShards: 8,
+			want: 8,
+		},
+		{
+			name:    "result never drops below minShards",
+			current: 3, inRate: 0, outRate: 100,
+			minShards: 2, maxShards: 8,
+			want: 2,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := desiredShards(c.current, c.inRate, c.outRate, c.queueEmpty, c.minShards, c.maxShards)
+			if got != c.want {
+				t.Errorf("desiredShards(%d, %v, %v, %v, %d, %d) = %d, want %d",
+					c.current, c.inRate, c.outRate, c.queueEmpty, c.minShards, c.maxShards, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// InputSeries is the JSON shape this tool reads from backfill files. It
+// supersedes model.SampleStream, which has no room for native histograms or
+// exemplars (this tool is pinned to an old prometheus/common that predates
+// them). The old float-only format - just "metric" and "values" - decodes
+// straight into an InputSeries unchanged, since Histograms and Exemplars are
+// optional and default to nil; there's no separate schema-version field.
+type InputSeries struct {
+	Metric     model.Metric       `json:"metric"`
+	Values     []model.SamplePair `json:"values,omitempty"`
+	Histograms []inputHistogram   `json:"histograms,omitempty"`
+	Exemplars  []inputExemplar    `json:"exemplars,omitempty"`
+}
+
+// inputBucketSpan mirrors a native histogram bucket span: Length
+// consecutive non-empty buckets starting Offset buckets after the end of
+// the previous span (or from the zero bucket, for the first span).
+type inputBucketSpan struct {
+	Offset int32  `json:"offset"`
+	Length uint32 `json:"length"`
+}
+
+// inputHistogram is the JSON shape of a native histogram sample. Field
+// names mirror prompb.Histogram's so mapping one onto the other (in
+// marshalV2Histogram) is mechanical.
+type inputHistogram struct {
+	Timestamp      int64             `json:"timestamp"`
+	Count          uint64            `json:"count"`
+	Sum            float64           `json:"sum"`
+	Schema         int32             `json:"schema"`
+	ZeroThreshold  float64           `json:"zero_threshold"`
+	ZeroCount      uint64            `json:"zero_count"`
+	PositiveSpans  []inputBucketSpan `json:"positive_spans,omitempty"`
+	PositiveDeltas []int64           `json:"positive_deltas,omitempty"`
+	NegativeSpans  []inputBucketSpan `json:"negative_spans,omitempty"`
+	NegativeDeltas []int64           `json:"negative_deltas,omitempty"`
+}
+
+// inputExemplar is the JSON shape of an exemplar attached to a series.
+type inputExemplar struct {
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// seriesRecord is what actually flows through the WAL and queue shards: a
+// classic TimeSeries (labels and float samples, the only thing the
+// vendored prompb.TimeSeries has room for) plus any native histograms and
+// exemplars that were attached to it. They ride alongside the TimeSeries
+// rather than inside it, and are only encoded onto the wire when sending
+// with --protocol=prw2 (see buildWriteRequestV2); prw1 sends the TimeSeries
+// as before and drops them, logging once.
+type seriesRecord struct {
+	ts         *prompb.TimeSeries
+	histograms []inputHistogram
+	exemplars  []inputExemplar
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WAL is a minimal append-only write-ahead log used to make the send queue
+// crash-resumable: every series is durably recorded on disk before it is
+// handed off to a shard for delivery, and a checkpoint file tracks how much
+// of the log has already been fully acknowledged by the remote endpoint.
+//
+// Each record is framed as [uvarint length][crc32(payload)][payload], which
+// lets a tailing reader detect a torn write left behind by a crash (the
+// length/crc won't line up) and simply stop reading rather than corrupt
+// state.
+type WAL struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	off  int64
+}
+
+// OpenWAL opens (creating if necessary) the WAL segment file inside dir.
+func OpenWAL(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating WAL dir: %w", err)
+	}
+	path := filepath.Join(dir, "wal.log")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening WAL segment: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &WAL{file: f, w: bufio.NewWriter(f), off: info.Size()}, nil
+}
+
+// Append durably writes payload to the log and returns the byte offset of
+// the record that follows it (i.e. the offset to resume from once payload
+// has been acknowledged).
+func (w *WAL) Append(payload []byte) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var hdr [8]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(payload)))
+	if _, err := w.w.Write(hdr[:n]); err != nil {
+		return 0, err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(payload))
+	if _, err := w.w.Write(sum[:]); err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(payload); err != nil {
+		return 0, err
+	}
+	if err := w.w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := w.file.Sync(); err != nil {
+		return 0, err
+	}
+	w.off += int64(n) + 4 + int64(len(payload))
+	return w.off, nil
+}
+
+// Close flushes and closes the underlying segment file.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// Path returns the path of the segment file, for opening independent
+// tailing readers.
+func (w *WAL) Path() string {
+	return w.file.Name()
+}
+
+// Offset returns the current write offset, synchronized so other
+// goroutines (e.g. main's drain-wait loop) can safely poll it while Append
+// runs concurrently.
+func (w *WAL) Offset() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.off
+}
+
+// WALReader tails a WAL segment from a given starting offset, blocking and
+// polling for new data once it catches up to the writer. off is only ever
+// mutated from the goroutine calling Next/tryRead, but is read via Offset
+// from other goroutines (e.g. main's drain-wait loop), so it's accessed
+// with sync/atomic rather than a plain field read/write.
+type WALReader struct {
+	f    *os.File
+	r    *bufio.Reader
+	off  int64
+	stop chan struct{}
+}
+
+// NewWALReader opens path for reading starting at offset off (0 to read
+// from the beginning of the log).
+func NewWALReader(path string, off int64) (*WALReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if off > 0 {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &WALReader{f: f, r: bufio.NewReader(f), off: off, stop: make(chan struct{})}, nil
+}
+
+// Next blocks until a record is available, the reader is stopped, or an
+// unrecoverable error (e.g. a checksum mismatch from a torn write) occurs.
+// It returns the record payload and the offset immediately following it.
+func (r *WALReader) Next() (payload []byte, offset int64, err error) {
+	for {
+		payload, offset, err = r.tryRead()
+		if err == io.EOF {
+			select {
+			case <-r.stop:
+				return nil, 0, io.EOF
+			case <-time.After(200 * time.Millisecond):
+				continue
+			}
+		}
+		return payload, offset, err
+	}
+}
+
+func (r *WALReader) tryRead() ([]byte, int64, error) {
+	off := atomic.LoadInt64(&r.off)
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if err == io.EOF {
+			// Rewind: nothing was consumed past the last good record.
+			if _, serr := r.f.Seek(off, io.SeekStart); serr != nil {
+				return nil, 0, serr
+			}
+			r.r.Reset(r.f)
+			return nil, 0, io.EOF
+		}
+		return nil, 0, err
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(r.r, sum[:]); err != nil {
+		r.f.Seek(off, io.SeekStart)
+		r.r.Reset(r.f)
+		return nil, 0, io.EOF
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		r.f.Seek(off, io.SeekStart)
+		r.r.Reset(r.f)
+		return nil, 0, io.EOF
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(sum[:]) {
+		return nil, 0, fmt.Errorf("wal: checksum mismatch at offset %d, log is corrupt", off)
+	}
+	newOff := off + int64(uvarintLen(length)) + 4 + int64(length)
+	atomic.StoreInt64(&r.off, newOff)
+	return payload, newOff, nil
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+// Offset returns the byte offset up to which the reader has successfully
+// read, safe to call concurrently with Next.
+func (r *WALReader) Offset() int64 {
+	return atomic.LoadInt64(&r.off)
+}
+
+// Stop unblocks a pending Next call and causes future calls to return
+// io.EOF.
+func (r *WALReader) Stop() {
+	close(r.stop)
+}
+
+// Close releases the underlying file descriptor.
+func (r *WALReader) Close() error {
+	return r.f.Close()
+}
+
+// checkpoint persists the offset up to which the WAL has been fully
+// acknowledged by the remote endpoint, so a restart against the same
+// --wal_dir can skip the records it already delivered.
+type checkpoint struct {
+	path string
+}
+
+func newCheckpoint(dir string) *checkpoint {
+	return &checkpoint{path: filepath.Join(dir, "checkpoint")}
+}
+
+// Load returns the last committed offset, or 0 if no checkpoint exists yet.
+func (c *checkpoint) Load() (int64, error) {
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// Save atomically persists offset as the new checkpoint.
+func (c *checkpoint) Save(offset int64) error {
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// ingestLog records which input files have already been fully appended to
+// the WAL, so resuming a crashed run against the same --wal_dir doesn't
+// re-ingest (and thereby durably duplicate) files it already queued before
+// the crash: the checkpoint only tracks delivery progress, not ingestion
+// progress, so without this a restart would re-append every input file's
+// records onto the WAL tail alongside the still-undelivered copy from the
+// previous run. It's a newline-delimited list of absolute input file
+// paths, each appended (and fsynced) only once that file's records have
+// all been durably written to the WAL. This only dedupes whole files: a
+// crash mid-file still re-ingests that one file's already-queued records
+// on resume.
+type ingestLog struct {
+	path string
+}
+
+func newIngestLog(dir string) *ingestLog {
+	return &ingestLog{path: filepath.Join(dir, "ingested.log")}
+}
+
+// Load returns the set of absolute input file paths already recorded as
+// fully ingested, or an empty set if no log exists yet.
+func (l *ingestLog) Load() (map[string]bool, error) {
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	done := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			done[line] = true
+		}
+	}
+	return done, nil
+}
+
+// MarkDone durably records path as fully ingested.
+func (l *ingestLog) MarkDone(path string) error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(path + "\n"); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// writev2 is a small hand-written encoder for the Prometheus Remote Write
+// 2.0 wire format (io.prometheus.write.v2.Request), copy/pasted in spirit
+// from prometheus/prometheus/prompb/io/prometheus/write/v2 (we don't take
+// the dependency itself, for the same vendoring reasons as
+// metricToLabelProtos below: see prometheus/issues/1720). It only encodes
+// the subset of the message this tool populates; field numbers match the
+// real .proto so any Remote Write 2.0 receiver can decode it.
+//
+// Wire field numbers (from the spec):
+//
+//	Request:    symbols=4 (repeated string), timeseries=5 (repeated TimeSeries)
+//	TimeSeries: labels_refs=1 (packed varint), samples=2, histograms=3,
+//	            exemplars=4, metadata=5, created_timestamp=6
+//	Sample:     value=1 (fixed64), timestamp=2 (varint)
+//	Exemplar:   labels_refs=1 (packed varint), value=2 (fixed64), timestamp=3 (varint)
+//	Metadata:   type=1 (varint), help_ref=3 (varint), unit_ref=4 (varint)
+//	Histogram:  count_int=1 (varint), sum=3 (fixed64), schema=4 (varint),
+//	            zero_threshold=5 (fixed64), zero_count_int=6 (varint),
+//	            negative_spans=8 (repeated BucketSpan), negative_deltas=9 (packed sint64),
+//	            positive_spans=11 (repeated BucketSpan), positive_deltas=12 (packed sint64),
+//	            timestamp=15 (varint)
+//	BucketSpan: offset=1 (sint32), length=2 (varint)
+
+// symbolTable interns label names/values (and metadata help/unit strings)
+// into a single per-request []string, so repeated TimeSeries can reference
+// them by index instead of repeating the bytes. Per spec, index 0 is
+// always the empty string.
+type symbolTable struct {
+	symbols []string
+	indices map[string]uint32
+}
+
+func newSymbolTable() *symbolTable {
+	t := &symbolTable{indices: map[string]uint32{"": 0}}
+	t.symbols = append(t.symbols, "")
+	return t
+}
+
+// ref returns s's index into the symbol table, interning it if necessary.
+func (t *symbolTable) ref(s string) uint32 {
+	if idx, ok := t.indices[s]; ok {
+		return idx
+	}
+	idx := uint32(len(t.symbols))
+	t.symbols = append(t.symbols, s)
+	t.indices[s] = idx
+	return idx
+}
+
+// writev2Metadata mirrors io.prometheus.write.v2.Metadata_MetricType; only
+// the "unknown" value is needed since this tool has no type information
+// for most inputs.
+const metricTypeUnknown = 0
+
+// v2Exemplar is the subset of io.prometheus.write.v2.Exemplar this tool
+// populates, built from an inputExemplar's labels once they've been
+// interned into the request's symbol table.
+type v2Exemplar struct {
+	labelRefs []uint32
+	value     float64
+	timestamp int64
+}
+
+// v2TimeSeries holds the fields of a Remote Write 2.0 TimeSeries message
+// that this tool populates.
+type v2TimeSeries struct {
+	labelRefs  []uint32
+	samples    []*prompb.Sample
+	histograms []inputHistogram
+	exemplars  []*v2Exemplar
+	typeRef    uint32
+	helpRef    uint32
+	unitRef    uint32
+}
+
+// buildWriteRequestV2 converts a batch of seriesRecords into a Remote Write
+// 2.0 Request, building a single symbol table shared by every series in
+// the batch. Metadata (type/help/unit) is derived from the __type__,
+// __help__, and __unit__ meta labels if the series carries them, or left
+// as "unknown"/empty otherwise. Unlike prw1, this carries each record's
+// native histograms and exemplars onto the wire.
+func buildWriteRequestV2(batch []*seriesRecord) []byte {
+	symbols := newSymbolTable()
+	series := make([]v2TimeSeries, 0, len(batch))
+
+	for _, rec := range batch {
+		v2ts := v2TimeSeries{samples: rec.ts.Samples, histograms: rec.histograms}
+		var typ, help, unit string
+		for _, l := range rec.ts.Labels {
+			switch l.Name {
+			case "__type__":
+				typ = l.Value
+				continue
+			case "__help__":
+				help = l.Value
+				continue
+			case "__unit__":
+				unit = l.Value
+				continue
+			}
+			v2ts.labelRefs = append(v2ts.labelRefs, symbols.ref(l.Name), symbols.ref(l.Value))
+		}
+		if typ != "" {
+			v2ts.typeRef = metadataTypeValue(typ)
+		} else {
+			v2ts.typeRef = metricTypeUnknown
+		}
+		v2ts.helpRef = symbols.ref(help)
+		v2ts.unitRef = symbols.ref(unit)
+		for _, e := range rec.exemplars {
+			names := make([]string, 0, len(e.Labels))
+			for name := range e.Labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			v2e := &v2Exemplar{value: e.Value, timestamp: e.Timestamp}
+			for _, name := range names {
+				v2e.labelRefs = append(v2e.labelRefs, symbols.ref(name), symbols.ref(e.Labels[name]))
+			}
+			v2ts.exemplars = append(v2ts.exemplars, v2e)
+		}
+		series = append(series, v2ts)
+	}
+
+	var buf bytes.Buffer
+	for _, s := range symbols.symbols {
+		appendStringField(&buf, 4, s)
+	}
+	for _, s := range series {
+		appendBytesField(&buf, 5, marshalV2TimeSeries(s))
+	}
+	return buf.Bytes()
+}
+
+// metadataTypeValue maps the handful of Prometheus metric type names found
+// in __type__ meta labels to the Metadata_MetricType enum values. Anything
+// unrecognized falls back to unknown (0).
+func metadataTypeValue(typ string) uint32 {
+	switch typ {
+	case "counter":
+		return 1
+	case "gauge":
+		return 2
+	case "histogram":
+		return 3
+	case "gaugehistogram":
+		return 4
+	case "summary":
+		return 5
+	case "info":
+		return 6
+	case "stateset":
+		return 7
+	default:
+		return metricTypeUnknown
+	}
+}
+
+func marshalV2TimeSeries(ts v2TimeSeries) []byte {
+	var buf bytes.Buffer
+	if len(ts.labelRefs) > 0 {
+		appendPackedVarintField(&buf, 1, ts.labelRefs)
+	}
+	for _, s := range ts.samples {
+		appendBytesField(&buf, 2, marshalV2Sample(s))
+	}
+	for _, h := range ts.histograms {
+		appendBytesField(&buf, 3, marshalV2Histogram(h))
+	}
+	for _, e := range ts.exemplars {
+		appendBytesField(&buf, 4, marshalV2Exemplar(e))
+	}
+	appendBytesField(&buf, 5, marshalV2Metadata(ts))
+	return buf.Bytes()
+}
+
+func marshalV2Sample(s *prompb.Sample) []byte {
+	var buf bytes.Buffer
+	appendFixed64Field(&buf, 1, math.Float64bits(s.Value))
+	appendVarintField(&buf, 2, uint64(s.Timestamp))
+	return buf.Bytes()
+}
+
+func marshalV2Exemplar(e *v2Exemplar) []byte {
+	var buf bytes.Buffer
+	if len(e.labelRefs) > 0 {
+		appendPackedVarintField(&buf, 1, e.labelRefs)
+	}
+	appendFixed64Field(&buf, 2, math.Float64bits(e.value))
+	appendVarintField(&buf, 3, uint64(e.timestamp))
+	return buf.Bytes()
+}
+
+// marshalV2Histogram encodes an inputHistogram as an
+// io.prometheus.write.v2.Histogram, using its integer (count_int/
+// zero_count_int) variants throughout since this tool's input schema only
+// carries integer counts.
+func marshalV2Histogram(h inputHistogram) []byte {
+	var buf bytes.Buffer
+	appendVarintField(&buf, 1, h.Count)
+	appendFixed64Field(&buf, 3, math.Float64bits(h.Sum))
+	appendInt32Field(&buf, 4, h.Schema)
+	appendFixed64Field(&buf, 5, math.Float64bits(h.ZeroThreshold))
+	appendVarintField(&buf, 6, h.ZeroCount)
+	for _, s := range h.NegativeSpans {
+		appendBytesField(&buf, 8, marshalV2BucketSpan(s))
+	}
+	if len(h.NegativeDeltas) > 0 {
+		appendPackedSintField(&buf, 9, h.NegativeDeltas)
+	}
+	for _, s := range h.PositiveSpans {
+		appendBytesField(&buf, 11, marshalV2BucketSpan(s))
+	}
+	if len(h.PositiveDeltas) > 0 {
+		appendPackedSintField(&buf, 12, h.PositiveDeltas)
+	}
+	appendVarintField(&buf, 15, uint64(h.Timestamp))
+	return buf.Bytes()
+}
+
+func marshalV2BucketSpan(s inputBucketSpan) []byte {
+	var buf bytes.Buffer
+	appendSintField(&buf, 1, int64(s.Offset))
+	appendVarintField(&buf, 2, uint64(s.Length))
+	return buf.Bytes()
+}
+
+func marshalV2Metadata(ts v2TimeSeries) []byte {
+	var buf bytes.Buffer
+	appendVarintField(&buf, 1, uint64(ts.typeRef))
+	appendVarintField(&buf, 3, uint64(ts.helpRef))
+	appendVarintField(&buf, 4, uint64(ts.unitRef))
+	return buf.Bytes()
+}
+
+// --- minimal protobuf wire helpers ---
+
+func appendTag(buf *bytes.Buffer, field int, wireType int) {
+	appendUvarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+func appendUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+func appendVarintField(buf *bytes.Buffer, field int, v uint64) {
+	appendTag(buf, field, 0)
+	appendUvarint(buf, v)
+}
+
+func appendFixed64Field(buf *bytes.Buffer, field int, v uint64) {
+	appendTag(buf, field, 1)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	buf.Write(tmp[:])
+}
+
+func appendBytesField(buf *bytes.Buffer, field int, b []byte) {
+	appendTag(buf, field, 2)
+	appendUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func appendStringField(buf *bytes.Buffer, field int, s string) {
+	appendBytesField(buf, field, []byte(s))
+}
+
+// appendPackedVarintField encodes vals as a single length-delimited field
+// containing their concatenated varint encodings, per proto3 "packed"
+// repeated scalar rules.
+func appendPackedVarintField(buf *bytes.Buffer, field int, vals []uint32) {
+	var packed bytes.Buffer
+	for _, v := range vals {
+		appendUvarint(&packed, uint64(v))
+	}
+	appendBytesField(buf, field, packed.Bytes())
+}
+
+// appendInt32Field encodes v as a proto3 int32 field: a varint of v
+// sign-extended to 64 bits, per the protobuf wire format (not zigzag -
+// that's what distinguishes int32 from sint32).
+func appendInt32Field(buf *bytes.Buffer, field int, v int32) {
+	appendVarintField(buf, field, uint64(int64(v)))
+}
+
+// zigzag64 maps a signed int64 to an unsigned value so small magnitudes
+// (positive or negative) encode as short varints, per the protobuf sint64
+// wire format.
+func zigzag64(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func appendSintField(buf *bytes.Buffer, field int, v int64) {
+	appendTag(buf, field, 0)
+	appendUvarint(buf, zigzag64(v))
+}
+
+// appendPackedSintField encodes vals as a single length-delimited field of
+// concatenated zigzag varints, per proto3 "packed" repeated sint64 rules.
+func appendPackedSintField(buf *bytes.Buffer, field int, vals []int64) {
+	var packed bytes.Buffer
+	for _, v := range vals {
+		appendUvarint(&packed, zigzag64(v))
+	}
+	appendBytesField(buf, field, packed.Bytes())
+}
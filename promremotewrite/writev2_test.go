@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// wireField is a decoded (field number, wire type, payload) triple, used by
+// the test-only decoder below to check what buildWriteRequestV2 produced
+// without pulling in a real protobuf library.
+type wireField struct {
+	num      int
+	wireType int
+	varint   uint64
+	fixed64  uint64
+	bytes    []byte
+}
+
+// decodeFields walks a buffer of consecutive protobuf fields, decoding just
+// enough (varint, fixed64, length-delimited) to check the encoder's output;
+// it mirrors the wire types marshalV2* actually emits.
+func decodeFields(t *testing.T, buf []byte) []wireField {
+	t.Helper()
+	var fields []wireField
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			t.Fatalf("decodeFields: bad tag varint at %v", buf)
+		}
+		buf = buf[n:]
+		f := wireField{num: int(tag >> 3), wireType: int(tag & 0x7)}
+		switch f.wireType {
+		case 0:
+			v, n := binary.Uvarint(buf)
+			if n <= 0 {
+				t.Fatalf("decodeFields: bad varint field at %v", buf)
+			}
+			f.varint = v
+			buf = buf[n:]
+		case 1:
+			f.fixed64 = binary.LittleEndian.Uint64(buf[:8])
+			buf = buf[8:]
+		case 2:
+			l, n := binary.Uvarint(buf)
+			if n <= 0 {
+				t.Fatalf("decodeFields: bad length varint at %v", buf)
+			}
+			buf = buf[n:]
+			f.bytes = buf[:l]
+			buf = buf[l:]
+		default:
+			t.Fatalf("decodeFields: unsupported wire type %d", f.wireType)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func fieldsByNum(fields []wireField, num int) []wireField {
+	var out []wireField
+	for _, f := range fields {
+		if f.num == num {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func TestBuildWriteRequestV2SymbolTableAndSample(t *testing.T) {
+	rec := &seriesRecord{
+		ts: &prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+			Samples: []*prompb.Sample{{Value: 1.5, Timestamp: 1000}},
+		},
+	}
+
+	out := buildWriteRequestV2([]*seriesRecord{rec})
+	fields := decodeFields(t, out)
+
+	symbols := fieldsByNum(fields, 4)
+	// Index 0 is always the empty string, per spec.
+	if len(symbols) == 0 || string(symbols[0].bytes) != "" {
+		t.Fatalf("first symbol = %q, want empty string", symbols[0].bytes)
+	}
+	for _, want := range []string{"__name__", "up", "job", "node"} {
+		found := false
+		for _, s := range symbols {
+			if string(s.bytes) == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("symbol table missing %q", want)
+		}
+	}
+
+	series := fieldsByNum(fields, 5)
+	if len(series) != 1 {
+		t.Fatalf("got %d timeseries fields, want 1", len(series))
+	}
+	tsFields := decodeFields(t, series[0].bytes)
+
+	labelRefs := fieldsByNum(tsFields, 1)
+	if len(labelRefs) != 1 {
+		t.Fatalf("got %d labels_refs fields, want 1 packed field", len(labelRefs))
+	}
+
+	sampleFields := fieldsByNum(tsFields, 2)
+	if len(sampleFields) != 1 {
+		t.Fatalf("got %d sample fields, want 1", len(sampleFields))
+	}
+	sample := decodeFields(t, sampleFields[0].bytes)
+	gotValue := math.Float64frombits(fieldsByNum(sample, 1)[0].fixed64)
+	if gotValue != 1.5 {
+		t.Errorf("sample value = %v, want 1.5", gotValue)
+	}
+	if gotTS := fieldsByNum(sample, 2)[0].varint; gotTS != 1000 {
+		t.Errorf("sample timestamp = %d, want 1000", gotTS)
+	}
+}
+
+func TestBuildWriteRequestV2Histogram(t *testing.T) {
+	h := inputHistogram{
+		Count: 42, Sum: 3.5, Schema: 3, ZeroThreshold: 0.001, ZeroCount: 1,
+		Timestamp: 500,
+	}
+	rec := &seriesRecord{
+		ts:         &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "h"}}},
+		histograms: []inputHistogram{h},
+	}
+
+	out := buildWriteRequestV2([]*seriesRecord{rec})
+	fields := decodeFields(t, out)
+	series := fieldsByNum(fields, 5)
+	if len(series) != 1 {
+		t.Fatalf("got %d timeseries fields, want 1", len(series))
+	}
+	tsFields := decodeFields(t, series[0].bytes)
+	histFields := fieldsByNum(tsFields, 3)
+	if len(histFields) != 1 {
+		t.Fatalf("got %d histogram fields, want 1", len(histFields))
+	}
+	hf := decodeFields(t, histFields[0].bytes)
+	if got := fieldsByNum(hf, 1)[0].varint; got != h.Count {
+		t.Errorf("count_int = %d, want %d", got, h.Count)
+	}
+	if got := math.Float64frombits(fieldsByNum(hf, 3)[0].fixed64); got != h.Sum {
+		t.Errorf("sum = %v, want %v", got, h.Sum)
+	}
+	if got := fieldsByNum(hf, 15)[0].varint; got != uint64(h.Timestamp) {
+		t.Errorf("timestamp = %d, want %d", got, h.Timestamp)
+	}
+}
+
+func TestBuildWriteRequestV2Exemplar(t *testing.T) {
+	rec := &seriesRecord{
+		ts: &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "e"}}},
+		exemplars: []inputExemplar{
+			{Timestamp: 777, Value: 9.5, Labels: map[string]string{"trace_id": "abc"}},
+		},
+	}
+
+	out := buildWriteRequestV2([]*seriesRecord{rec})
+	fields := decodeFields(t, out)
+	series := fieldsByNum(fields, 5)
+	tsFields := decodeFields(t, series[0].bytes)
+	exFields := fieldsByNum(tsFields, 4)
+	if len(exFields) != 1 {
+		t.Fatalf("got %d exemplar fields, want 1", len(exFields))
+	}
+	ef := decodeFields(t, exFields[0].bytes)
+	if got := math.Float64frombits(fieldsByNum(ef, 2)[0].fixed64); got != 9.5 {
+		t.Errorf("exemplar value = %v, want 9.5", got)
+	}
+	if got := fieldsByNum(ef, 3)[0].varint; got != 777 {
+		t.Errorf("exemplar timestamp = %d, want 777", got)
+	}
+	if len(fieldsByNum(ef, 1)) != 1 {
+		t.Fatal("expected a packed labels_refs field on the exemplar")
+	}
+}
+
+func TestSymbolTableInterning(t *testing.T) {
+	st := newSymbolTable()
+	a := st.ref("foo")
+	b := st.ref("bar")
+	c := st.ref("foo")
+	if a != c {
+		t.Errorf("ref(%q) returned different indices on repeat calls: %d vs %d", "foo", a, c)
+	}
+	if a == b {
+		t.Errorf("ref(%q) and ref(%q) collided at index %d", "foo", "bar", a)
+	}
+	if st.symbols[0] != "" {
+		t.Errorf("symbols[0] = %q, want empty string", st.symbols[0])
+	}
+}